@@ -1,11 +1,12 @@
 package users
 
 import (
-	"errors"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"time"
 
-	"github.com/dgrijalva/jwt-go"
+	"github.com/golang-jwt/jwt/v4"
 	"github.com/trackit/trackit2/config"
 	"github.com/trackit/trackit2/db"
 	"golang.org/x/crypto/bcrypt"
@@ -14,14 +15,18 @@ import (
 var (
 	bCryptCost uint
 	jwtIssuer  string
-	jwtSecret  []byte
+	jwtKeys    *KeySet
 )
 
 func init() {
 	c := config.LoadConfiguration()
 	bCryptCost = c.HashDifficulty
 	jwtIssuer = c.AuthIssuer
-	jwtSecret = c.AuthSecret
+	var err error
+	jwtKeys, err = loadKeySet(c)
+	if err != nil {
+		panic(fmt.Sprintf("users: failed to load JWT key set: %s", err))
+	}
 }
 
 // getPasswordHash generates a hash string for a given password.
@@ -37,31 +42,35 @@ func passwordMatchesHash(password, hash string) error {
 
 // jwtClaims represents the JWT claims used by this software, as a structure.
 type jwtClaims struct {
-	Issuer    string `json:"iss"`
-	NotBefore int64  `json:"nbf"`
-	Expires   int64  `json:"exp"`
-	Subject   int    `json:"sub"`
+	Issuer      string   `json:"iss"`
+	NotBefore   int64    `json:"nbf"`
+	Expires     int64    `json:"exp"`
+	Subject     int      `json:"sub"`
+	Version     int      `json:"ver"`
+	Jti         string   `json:"jti"`
+	Amr         []string `json:"amr"`
+	MfaRequired bool     `json:"mfa_required"`
 	jwt.StandardClaims
 }
 
-// generateToken generates a valid JWT token for a given user.
-func generateToken(user User) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwtClaims{
-		Issuer:    jwtIssuer,
-		NotBefore: time.Now().Add(-1 * time.Hour).Unix(),
-		Expires:   time.Now().Add(60 * 24 * time.Hour).Unix(),
-		Subject:   user.Id,
-	})
-	return token.SignedString([]byte(jwtSecret))
+// newJti generates a random, URL-safe token id suitable for use as a jti
+// claim.
+func newJti() (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
 }
 
-// getTokenSigningKey is used by jwt-go to check whether a token is acceptable
-// before verifying it.
-func getTokenSigningKey(token *jwt.Token) (interface{}, error) {
-	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-		return nil, fmt.Errorf("Unexpected signing method: %v.", token.Header["alg"])
-	} else {
-		return jwtSecret, nil
+// getTokenSigningKeyFor returns a jwt.Keyfunc that only ever accepts the
+// given key, checking that the token's algorithm matches it.
+func getTokenSigningKeyFor(key *jwtKey) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		if token.Method.Alg() != key.Method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return key.VerifyKey, nil
 	}
 }
 
@@ -72,22 +81,101 @@ func areClaimsValid(claims jwtClaims) bool {
 	return claims.Issuer == jwtIssuer && claims.NotBefore <= now && now < claims.Expires
 }
 
+// verifyAccessToken validates a trackit-issued access token's signature and
+// claims, checks it against the revocation blacklist and the owning user's
+// token version, and resolves the User it was issued for. It does not check
+// the account's two-factor authentication requirement: most callers want
+// testToken instead, which does; verifyAccessToken is exposed for the
+// narrow case of a login step that still needs to identify the account
+// behind a not-yet-MFA-complete token, such as recovery code redemption.
+func verifyAccessToken(tokenString string) (User, jwtClaims, error) {
+	var user User
+	token, _, err := parseTokenWithKeySet(tokenString)
+	if err != nil {
+		return user, jwtClaims{}, err
+	}
+	claims, ok := token.Claims.(*jwtClaims)
+	if !ok || !token.Valid {
+		return user, jwtClaims{}, fmt.Errorf("failed to read token")
+	}
+	if !areClaimsValid(*claims) {
+		return user, jwtClaims{}, fmt.Errorf("claims are invalid")
+	}
+	if revoked, err := isJtiRevoked(db.Db, claims.Jti); err != nil {
+		return user, jwtClaims{}, err
+	} else if revoked {
+		return user, jwtClaims{}, fmt.Errorf("token has been revoked")
+	}
+	user, err = GetUserWithId(db.Db, claims.Subject)
+	if err != nil {
+		return user, jwtClaims{}, err
+	}
+	if claims.Version < user.TokenVersion {
+		return User{}, jwtClaims{}, fmt.Errorf("token has been invalidated")
+	}
+	return user, *claims, nil
+}
+
 // testToken checks whether a JWT token is valid and retrieves the owning User
-// if it is.
+// if it is. It verifies against the key named by the token's "kid" header
+// when present, and otherwise tries every currently active key in turn. A
+// token is further rejected if its jti has been individually revoked, if
+// its version is behind the owning user's current token version (i.e. the
+// user logged out of all sessions since the token was issued), or if it
+// does not satisfy the owning account's two-factor authentication
+// requirement.
 func testToken(tokenString string) (User, error) {
-	var user User
-	token, err := jwt.ParseWithClaims(tokenString, &jwtClaims{}, getTokenSigningKey)
-	if err == nil {
-		if claims, ok := token.Claims.(*jwtClaims); ok && token.Valid {
-			if areClaimsValid(*claims) {
-				userId := claims.Subject
-				user, err = GetUserWithId(db.Db, userId)
-			} else {
-				err = errors.New("Claims are invalid.")
-			}
-		} else {
-			err = errors.New("Failed to read token.")
+	user, claims, err := verifyAccessToken(tokenString)
+	if err != nil {
+		return user, err
+	}
+	if user.TotpEnabled && !containsAmr(claims.Amr, "otp") && !containsAmr(claims.Amr, "recovery") {
+		return User{}, fmt.Errorf("token does not satisfy this account's two-factor authentication requirement")
+	}
+	return user, nil
+}
+
+// containsAmr reports whether method is among the amr (Authentication
+// Methods References) values a token was issued with.
+func containsAmr(amr []string, method string) bool {
+	for _, m := range amr {
+		if m == method {
+			return true
 		}
 	}
-	return user, err
-}
\ No newline at end of file
+	return false
+}
+
+// parseTokenWithKeySet parses and verifies tokenString against jwtKeys,
+// returning the key that succeeded in verifying it.
+func parseTokenWithKeySet(tokenString string) (*jwt.Token, *jwtKey, error) {
+	unverified := &jwt.Parser{}
+	var claims jwtClaims
+	parsedUnverified, _, err := unverified.ParseUnverified(tokenString, &claims)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read token: %w", err)
+	}
+	if kid, ok := parsedUnverified.Header["kid"].(string); ok && kid != "" {
+		key, ok := jwtKeys.Get(kid)
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown key id %q", kid)
+		}
+		if !key.isActive(time.Now()) {
+			return nil, nil, fmt.Errorf("key id %q is not currently active", kid)
+		}
+		token, err := jwt.ParseWithClaims(tokenString, &jwtClaims{}, getTokenSigningKeyFor(key))
+		return token, key, err
+	}
+	var lastErr error
+	for _, key := range jwtKeys.Active() {
+		token, err := jwt.ParseWithClaims(tokenString, &jwtClaims{}, getTokenSigningKeyFor(key))
+		if err == nil {
+			return token, key, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no active key could verify the token")
+	}
+	return nil, nil, lastErr
+}
@@ -0,0 +1,51 @@
+package users
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// GetUserWithExternalSubject looks up the trackit User previously linked to
+// a third-party OAuth2/OIDC identity, identified by the issuer that
+// authenticated it and the subject it asserts for that user. It is the
+// counterpart to CreateUserWithExternalSubject.
+func GetUserWithExternalSubject(sqlDb *sql.DB, issuer, subject string) (User, error) {
+	var user User
+	const query = `SELECT u.id, u.email, u.password, u.token_version, u.totp_secret, u.totp_enabled, u.is_admin
+		FROM user u
+		JOIN user_external_subjects ext ON ext.user_id = u.id
+		WHERE ext.issuer=? AND ext.subject=?`
+	err := sqlDb.QueryRow(query, issuer, subject).Scan(
+		&user.Id, &user.Email, &user.Password, &user.TokenVersion, &user.TotpSecret, &user.TotpEnabled, &user.IsAdmin)
+	return user, err
+}
+
+// CreateUserWithExternalSubject provisions a brand new trackit User for a
+// third-party identity that has never signed in before, and links the two so
+// future logins resolve through GetUserWithExternalSubject. It is only
+// called for providers configured with AutoProvision.
+func CreateUserWithExternalSubject(sqlDb *sql.DB, issuer, subject string) (User, error) {
+	var user User
+	tx, err := sqlDb.Begin()
+	if err != nil {
+		return user, err
+	}
+	defer tx.Rollback()
+	const insertUser = `INSERT INTO user(email, password, token_version, totp_enabled, is_admin) VALUES (?, '', 0, false, false)`
+	res, err := tx.Exec(insertUser, fmt.Sprintf("%s:%s", issuer, subject))
+	if err != nil {
+		return user, fmt.Errorf("failed to provision user: %w", err)
+	}
+	userId, err := res.LastInsertId()
+	if err != nil {
+		return user, fmt.Errorf("failed to read provisioned user id: %w", err)
+	}
+	const insertExternal = `INSERT INTO user_external_subjects(issuer, subject, user_id) VALUES (?, ?, ?)`
+	if _, err := tx.Exec(insertExternal, issuer, subject, userId); err != nil {
+		return user, fmt.Errorf("failed to link external subject: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return user, err
+	}
+	return GetUserWithId(sqlDb, int(userId))
+}
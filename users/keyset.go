@@ -0,0 +1,377 @@
+package users
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/trackit/trackit2/config"
+)
+
+// jwtKey is a single key trackit can use to sign and/or verify JWT tokens.
+type jwtKey struct {
+	Id         string
+	Method     jwt.SigningMethod
+	SigningKey interface{} // nil once the key has been retired
+	VerifyKey  interface{}
+	NotBefore  time.Time
+	NotAfter   time.Time // zero means "no expiry"
+}
+
+// isActive reports whether the key is currently usable to verify tokens.
+func (k *jwtKey) isActive(now time.Time) bool {
+	if now.Before(k.NotBefore) {
+		return false
+	}
+	return k.NotAfter.IsZero() || now.Before(k.NotAfter)
+}
+
+// KeySet holds the ordered collection of keys trackit accepts to verify JWT
+// tokens, plus the single key currently used to sign new ones. It is safe
+// for concurrent use so keys can be rotated at runtime without restarting
+// the server.
+type KeySet struct {
+	mu        sync.RWMutex
+	keys      map[string]*jwtKey
+	order     []string
+	currentId string
+}
+
+// NewKeySet creates an empty KeySet.
+func NewKeySet() *KeySet {
+	return &KeySet{keys: make(map[string]*jwtKey)}
+}
+
+// AddKey registers a key in the set. If asCurrent is true, it becomes the
+// key used to sign new tokens.
+func (ks *KeySet) AddKey(key *jwtKey, asCurrent bool) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if _, exists := ks.keys[key.Id]; !exists {
+		ks.order = append(ks.order, key.Id)
+	}
+	ks.keys[key.Id] = key
+	if asCurrent {
+		ks.currentId = key.Id
+	}
+}
+
+// RetireKey stops a key from being used to sign new tokens, while keeping it
+// available to verify tokens already issued with it until notAfter.
+func (ks *KeySet) RetireKey(id string, notAfter time.Time) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	key, ok := ks.keys[id]
+	if !ok {
+		return fmt.Errorf("unknown key id %q", id)
+	}
+	if ks.currentId == id {
+		return fmt.Errorf("cannot retire the current signing key %q, promote another key first", id)
+	}
+	retired := *key
+	retired.SigningKey = nil
+	retired.NotAfter = notAfter
+	ks.keys[id] = &retired
+	return nil
+}
+
+// Current returns the key currently used to sign new tokens.
+func (ks *KeySet) Current() (*jwtKey, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	key, ok := ks.keys[ks.currentId]
+	if !ok {
+		return nil, fmt.Errorf("no current signing key configured")
+	}
+	return key, nil
+}
+
+// Get returns the key with the given id, if it is known to the set.
+func (ks *KeySet) Get(id string) (*jwtKey, bool) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	key, ok := ks.keys[id]
+	return key, ok
+}
+
+// Active returns the keys currently usable to verify tokens, in the order
+// they were added.
+func (ks *KeySet) Active() []*jwtKey {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	now := time.Now()
+	active := make([]*jwtKey, 0, len(ks.order))
+	for _, id := range ks.order {
+		if key := ks.keys[id]; key.isActive(now) {
+			active = append(active, key)
+		}
+	}
+	return active
+}
+
+// loadKeySet builds the KeySet trackit signs and verifies tokens with, from
+// the key entries configured in c.AuthKeys. At least one entry must be
+// marked current; when several are, the last of them is used to sign.
+func loadKeySet(c config.Config) (*KeySet, error) {
+	ks := NewKeySet()
+	for _, kc := range c.AuthKeys {
+		method := jwt.GetSigningMethod(kc.Algorithm)
+		if method == nil {
+			return nil, fmt.Errorf("unknown JWT signing algorithm %q for key %q", kc.Algorithm, kc.Id)
+		}
+		signingKey, verifyKey, err := loadKeyMaterial(method, kc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load key %q: %w", kc.Id, err)
+		}
+		key := &jwtKey{
+			Id:         kc.Id,
+			Method:     method,
+			SigningKey: signingKey,
+			VerifyKey:  verifyKey,
+			NotBefore:  kc.NotBefore,
+			NotAfter:   kc.NotAfter,
+		}
+		if !kc.Current {
+			key.SigningKey = nil
+		}
+		ks.AddKey(key, kc.Current)
+	}
+	if _, err := ks.Current(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// loadKeyMaterial builds the signing and verification key for a single
+// config.AuthKeyConfig entry. Symmetric algorithms (HSxxx) sign and verify
+// with the same secret; asymmetric algorithms load a PEM key pair from disk.
+func loadKeyMaterial(method jwt.SigningMethod, kc config.AuthKeyConfig) (interface{}, interface{}, error) {
+	switch method.(type) {
+	case *jwt.SigningMethodHMAC:
+		return kc.Secret, kc.Secret, nil
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		return loadRSAKeyPair(kc.PrivateKeyFile, kc.PublicKeyFile)
+	case *jwt.SigningMethodECDSA:
+		return loadECDSAKeyPair(kc.PrivateKeyFile, kc.PublicKeyFile)
+	case *jwt.SigningMethodEd25519:
+		return loadEd25519KeyPair(kc.PrivateKeyFile, kc.PublicKeyFile)
+	default:
+		return nil, nil, fmt.Errorf("unsupported JWT signing algorithm %q", kc.Algorithm)
+	}
+}
+
+func loadRSAKeyPair(privateKeyFile, publicKeyFile string) (interface{}, interface{}, error) {
+	privPem, err := ioutil.ReadFile(privateKeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read RSA private key file: %w", err)
+	}
+	priv, err := jwt.ParseRSAPrivateKeyFromPEM(privPem)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse RSA private key: %w", err)
+	}
+	pubPem, err := ioutil.ReadFile(publicKeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read RSA public key file: %w", err)
+	}
+	pub, err := jwt.ParseRSAPublicKeyFromPEM(pubPem)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse RSA public key: %w", err)
+	}
+	return priv, pub, nil
+}
+
+func loadECDSAKeyPair(privateKeyFile, publicKeyFile string) (interface{}, interface{}, error) {
+	privPem, err := ioutil.ReadFile(privateKeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read ECDSA private key file: %w", err)
+	}
+	priv, err := jwt.ParseECPrivateKeyFromPEM(privPem)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse ECDSA private key: %w", err)
+	}
+	pubPem, err := ioutil.ReadFile(publicKeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read ECDSA public key file: %w", err)
+	}
+	pub, err := jwt.ParseECPublicKeyFromPEM(pubPem)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse ECDSA public key: %w", err)
+	}
+	return priv, pub, nil
+}
+
+func loadEd25519KeyPair(privateKeyFile, publicKeyFile string) (interface{}, interface{}, error) {
+	privPem, err := ioutil.ReadFile(privateKeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read Ed25519 private key file: %w", err)
+	}
+	priv, err := jwt.ParseEdPrivateKeyFromPEM(privPem)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse Ed25519 private key: %w", err)
+	}
+	pubPem, err := ioutil.ReadFile(publicKeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read Ed25519 public key file: %w", err)
+	}
+	pub, err := jwt.ParseEdPublicKeyFromPEM(pubPem)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse Ed25519 public key: %w", err)
+	}
+	return priv, pub, nil
+}
+
+// addKeyRequest is the payload accepted by the admin "add key" endpoint.
+type addKeyRequest struct {
+	Id             string `json:"id"`
+	Algorithm      string `json:"algorithm"`
+	Secret         string `json:"secret,omitempty"`
+	PrivateKeyFile string `json:"privateKeyFile,omitempty"`
+	PublicKeyFile  string `json:"publicKeyFile,omitempty"`
+	Current        bool   `json:"current"`
+}
+
+// HandleAddKey is an admin-only HTTP handler that adds a new verification
+// key to the running server's KeySet, optionally promoting it to be the key
+// used to sign new tokens. It lets an operator roll a new signing key in
+// before retiring the old one, for zero-downtime rotation.
+func HandleAddKey(w http.ResponseWriter, r *http.Request, user User) {
+	if !user.IsAdmin {
+		http.Error(w, "admin privileges required", http.StatusForbidden)
+		return
+	}
+	var req addKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body: %s", err), http.StatusBadRequest)
+		return
+	}
+	method := jwt.GetSigningMethod(req.Algorithm)
+	if method == nil {
+		http.Error(w, fmt.Sprintf("unknown JWT signing algorithm %q", req.Algorithm), http.StatusBadRequest)
+		return
+	}
+	signingKey, verifyKey, err := loadKeyMaterial(method, config.AuthKeyConfig{
+		Algorithm:      req.Algorithm,
+		Secret:         req.Secret,
+		PrivateKeyFile: req.PrivateKeyFile,
+		PublicKeyFile:  req.PublicKeyFile,
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to load key: %s", err), http.StatusBadRequest)
+		return
+	}
+	jwtKeys.AddKey(&jwtKey{
+		Id:         req.Id,
+		Method:     method,
+		SigningKey: signingKey,
+		VerifyKey:  verifyKey,
+		NotBefore:  time.Now(),
+	}, req.Current)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// retireKeyRequest is the payload accepted by the admin "retire key"
+// endpoint.
+type retireKeyRequest struct {
+	NotAfter time.Time `json:"notAfter"`
+}
+
+// HandleRetireKey is an admin-only HTTP handler that stops a key from
+// signing new tokens while keeping it available to verify tokens already
+// issued with it until notAfter.
+func HandleRetireKey(w http.ResponseWriter, r *http.Request, user User, keyId string) {
+	if !user.IsAdmin {
+		http.Error(w, "admin privileges required", http.StatusForbidden)
+		return
+	}
+	var req retireKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body: %s", err), http.StatusBadRequest)
+		return
+	}
+	if req.NotAfter.IsZero() {
+		req.NotAfter = time.Now()
+	}
+	if err := jwtKeys.RetireKey(keyId, req.NotAfter); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// jwk is a single JSON Web Key, as served by the JWKS endpoint, covering the
+// RSA, EC and OKP (Ed25519) key types used by trackit's asymmetric signing
+// algorithms.
+type jwk struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// HandleJwks serves trackit's public verification keys as a JWKS document
+// (RFC 7517) so downstream services can verify trackit-issued tokens
+// without sharing secrets. Symmetric (HSxxx) keys are never published.
+func HandleJwks(w http.ResponseWriter, r *http.Request) {
+	keys := make([]jwk, 0, len(jwtKeys.Active()))
+	for _, key := range jwtKeys.Active() {
+		if k, ok := jwkFromKey(key); ok {
+			keys = append(keys, k)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Keys []jwk `json:"keys"`
+	}{keys})
+}
+
+// jwkFromKey converts an asymmetric key's public half into a JWK. It
+// returns false for symmetric (HSxxx) keys, which are never published.
+func jwkFromKey(key *jwtKey) (jwk, bool) {
+	switch pub := key.VerifyKey.(type) {
+	case *rsa.PublicKey:
+		return jwk{
+			Kty: "RSA",
+			Use: "sig",
+			Kid: key.Id,
+			Alg: key.Method.Alg(),
+			N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}, true
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		return jwk{
+			Kty: "EC",
+			Use: "sig",
+			Kid: key.Id,
+			Alg: key.Method.Alg(),
+			Crv: pub.Curve.Params().Name,
+			X:   base64.RawURLEncoding.EncodeToString(pub.X.FillBytes(make([]byte, size))),
+			Y:   base64.RawURLEncoding.EncodeToString(pub.Y.FillBytes(make([]byte, size))),
+		}, true
+	case ed25519.PublicKey:
+		return jwk{
+			Kty: "OKP",
+			Use: "sig",
+			Kid: key.Id,
+			Alg: key.Method.Alg(),
+			Crv: "Ed25519",
+			X:   base64.RawURLEncoding.EncodeToString(pub),
+		}, true
+	default:
+		return jwk{}, false
+	}
+}
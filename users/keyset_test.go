@@ -0,0 +1,72 @@
+package users
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJwtKeyIsActive(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		name      string
+		notBefore time.Time
+		notAfter  time.Time
+		want      bool
+	}{
+		{"no window", time.Time{}, time.Time{}, true},
+		{"not yet valid", now.Add(time.Hour), time.Time{}, false},
+		{"retired", now.Add(-2 * time.Hour), now.Add(-time.Hour), false},
+		{"within window", now.Add(-time.Hour), now.Add(time.Hour), true},
+		{"at notBefore", now, time.Time{}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			key := &jwtKey{NotBefore: c.notBefore, NotAfter: c.notAfter}
+			if got := key.isActive(now); got != c.want {
+				t.Errorf("isActive() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestKeySetActiveExcludesRetiredAndFutureKeys(t *testing.T) {
+	now := time.Now()
+	ks := NewKeySet()
+	ks.AddKey(&jwtKey{Id: "current"}, true)
+	ks.AddKey(&jwtKey{Id: "retired", NotAfter: now.Add(-time.Minute)}, false)
+	ks.AddKey(&jwtKey{Id: "future", NotBefore: now.Add(time.Minute)}, false)
+
+	active := ks.Active()
+	if len(active) != 1 || active[0].Id != "current" {
+		t.Fatalf("Active() = %v, want only %q", active, "current")
+	}
+
+	if _, ok := ks.Get("retired"); !ok {
+		t.Fatalf("Get(%q) should still find a retired key for isActive checks to reject", "retired")
+	}
+}
+
+func TestHandleAddKeyRejectsNonAdmin(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/user/keys", strings.NewReader(`{}`))
+	rec := httptest.NewRecorder()
+
+	HandleAddKey(rec, req, User{Id: 1, IsAdmin: false})
+
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("HandleAddKey() status = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+}
+
+func TestHandleRetireKeyRejectsNonAdmin(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/user/keys/some-key/retire", strings.NewReader(`{}`))
+	rec := httptest.NewRecorder()
+
+	HandleRetireKey(rec, req, User{Id: 1, IsAdmin: false}, "some-key")
+
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("HandleRetireKey() status = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,325 @@
+package users
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/trackit/trackit2/config"
+	"github.com/trackit/trackit2/db"
+)
+
+// oauthProvider describes a third-party OAuth2/OIDC provider that trackit
+// trusts to authenticate users, in addition to its own HS256/asymmetric JWT
+// tokens. A provider is verified via IntrospectionUrl (RFC 7662) when set;
+// otherwise, if JwksUrl is set, its bearer tokens are verified locally as
+// OIDC ID tokens against the provider's published signing keys.
+type oauthProvider struct {
+	Issuer           string
+	IntrospectionUrl string
+	ClientId         string
+	ClientSecret     string
+	JwksUrl          string
+	AutoProvision    bool
+}
+
+// oauthProviders maps an issuer to its configuration. It is populated once
+// at startup from config and never mutated afterwards.
+var oauthProviders map[string]oauthProvider
+
+func init() {
+	providers := config.LoadConfiguration().OAuthProviders
+	oauthProviders = make(map[string]oauthProvider, len(providers))
+	for _, p := range providers {
+		oauthProviders[p.Issuer] = oauthProvider{
+			Issuer:           p.Issuer,
+			IntrospectionUrl: p.IntrospectionUrl,
+			ClientId:         p.ClientId,
+			ClientSecret:     p.ClientSecret,
+			JwksUrl:          p.JwksUrl,
+			AutoProvision:    p.AutoProvision,
+		}
+	}
+}
+
+// introspectionResponse is the subset of RFC 7662 token introspection
+// response that trackit cares about.
+type introspectionResponse struct {
+	Active bool   `json:"active"`
+	Sub    string `json:"sub"`
+	Iss    string `json:"iss"`
+}
+
+// introspectToken calls a provider's introspection endpoint to validate a
+// bearer token and retrieve the subject it was issued for.
+func introspectToken(ctx context.Context, provider oauthProvider, token string) (introspectionResponse, error) {
+	var result introspectionResponse
+	form := url.Values{"token": {token}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, provider.IntrospectionUrl, strings.NewReader(form.Encode()))
+	if err != nil {
+		return result, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(provider.ClientId, provider.ClientSecret)
+	client := http.Client{Timeout: 10 * time.Second}
+	res, err := client.Do(req)
+	if err != nil {
+		return result, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return result, fmt.Errorf("introspection endpoint returned status %d", res.StatusCode)
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return result, fmt.Errorf("failed to decode introspection response: %w", err)
+	}
+	if !result.Active {
+		return result, fmt.Errorf("token is not active")
+	}
+	return result, nil
+}
+
+// jwksCacheTTL is how long a provider's fetched JWKS document is trusted
+// before verifyIdToken fetches it again, so that key rotation on the
+// provider's side is picked up without needing a restart, while still
+// sparing it a request per login.
+const jwksCacheTTL = 10 * time.Minute
+
+// jwksCache memoizes the JWKS document fetched from each provider's JwksUrl.
+var (
+	jwksCacheMu sync.Mutex
+	jwksCache   = make(map[string]struct {
+		keys      []jwk
+		fetchedAt time.Time
+	})
+)
+
+// fetchProviderJwks returns the signing keys published at provider.JwksUrl,
+// reusing a cached copy younger than jwksCacheTTL.
+func fetchProviderJwks(ctx context.Context, provider oauthProvider) ([]jwk, error) {
+	jwksCacheMu.Lock()
+	if entry, ok := jwksCache[provider.JwksUrl]; ok && time.Since(entry.fetchedAt) < jwksCacheTTL {
+		jwksCacheMu.Unlock()
+		return entry.keys, nil
+	}
+	jwksCacheMu.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, provider.JwksUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := http.Client{Timeout: 10 * time.Second}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("jwks endpoint returned status %d", res.StatusCode)
+	}
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("failed to decode jwks document: %w", err)
+	}
+
+	jwksCacheMu.Lock()
+	jwksCache[provider.JwksUrl] = struct {
+		keys      []jwk
+		fetchedAt time.Time
+	}{doc.Keys, time.Now()}
+	jwksCacheMu.Unlock()
+	return doc.Keys, nil
+}
+
+// idTokenClaims is the subset of OIDC ID token claims trackit checks when
+// verifying a bearer token against a provider's JWKS instead of its
+// introspection endpoint.
+type idTokenClaims struct {
+	Issuer  string `json:"iss"`
+	Subject string `json:"sub"`
+	jwt.StandardClaims
+}
+
+// verifyIdToken verifies tokenString as an OIDC ID token signed by one of
+// provider's published JWKS keys, for providers that expose no introspection
+// endpoint. Per OIDC core it also checks the token's issuer and that its
+// audience names trackit's client id for that provider, so an otherwise
+// valid ID token issued to a different client cannot be replayed here. It
+// reports the same introspectionResponse shape as introspectToken so both
+// verification paths are interchangeable to callers.
+func verifyIdToken(ctx context.Context, provider oauthProvider, tokenString string) (introspectionResponse, error) {
+	var result introspectionResponse
+	keys, err := fetchProviderJwks(ctx, provider)
+	if err != nil {
+		return result, fmt.Errorf("failed to fetch provider signing keys: %w", err)
+	}
+	var claims idTokenClaims
+	token, err := jwt.ParseWithClaims(tokenString, &claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		for _, k := range keys {
+			if k.Kid == kid {
+				return publicKeyFromJwk(k)
+			}
+		}
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	})
+	if err != nil {
+		return result, fmt.Errorf("failed to verify id token: %w", err)
+	}
+	if !token.Valid {
+		return result, fmt.Errorf("id token is not valid")
+	}
+	if claims.Issuer != provider.Issuer {
+		return result, fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	}
+	if !claims.VerifyAudience(provider.ClientId, true) {
+		return result, fmt.Errorf("id token is not addressed to this client")
+	}
+	result.Active = true
+	result.Sub = claims.Subject
+	result.Iss = claims.Issuer
+	return result, nil
+}
+
+// publicKeyFromJwk converts a JWK's public-key fields into a Go key usable
+// to verify a token, covering the same RSA, EC and OKP (Ed25519) key types
+// jwkFromKey (keyset.go) produces.
+func publicKeyFromJwk(k jwk) (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		nBytes, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RSA modulus: %w", err)
+		}
+		eBytes, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RSA exponent: %w", err)
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(nBytes),
+			E: int(new(big.Int).SetBytes(eBytes).Int64()),
+		}, nil
+	case "EC":
+		curve, err := ecdsaCurveByName(k.Crv)
+		if err != nil {
+			return nil, err
+		}
+		xBytes, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EC x coordinate: %w", err)
+		}
+		yBytes, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EC y coordinate: %w", err)
+		}
+		return &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(xBytes),
+			Y:     new(big.Int).SetBytes(yBytes),
+		}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported OKP curve %q", k.Crv)
+		}
+		xBytes, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Ed25519 public key: %w", err)
+		}
+		return ed25519.PublicKey(xBytes), nil
+	default:
+		return nil, fmt.Errorf("unsupported JWK key type %q", k.Kty)
+	}
+}
+
+// ecdsaCurveByName returns the elliptic.Curve named by a JWK "crv" value.
+func ecdsaCurveByName(name string) (elliptic.Curve, error) {
+	switch name {
+	case "P-256":
+		return elliptic.P256(), nil
+	case "P-384":
+		return elliptic.P384(), nil
+	case "P-521":
+		return elliptic.P521(), nil
+	default:
+		return nil, fmt.Errorf("unsupported EC curve %q", name)
+	}
+}
+
+// testOAuthToken validates a bearer token against the provider identified by
+// issuer, and resolves it to a trackit User, auto-provisioning one if the
+// provider allows it. The token is verified via the provider's introspection
+// endpoint when configured, and falls back to local JWKS-based ID token
+// verification otherwise.
+func testOAuthToken(ctx context.Context, issuer, tokenString string) (User, error) {
+	var user User
+	provider, ok := oauthProviders[issuer]
+	if !ok {
+		return user, fmt.Errorf("unknown OAuth issuer %q", issuer)
+	}
+	verify := introspectToken
+	if provider.IntrospectionUrl == "" {
+		if provider.JwksUrl == "" {
+			return user, fmt.Errorf("provider %q has neither an introspection nor a jwks endpoint configured", issuer)
+		}
+		verify = verifyIdToken
+	}
+	result, err := verify(ctx, provider, tokenString)
+	if err != nil {
+		return user, err
+	}
+	user, err = GetUserWithExternalSubject(db.Db, issuer, result.Sub)
+	if err == nil {
+		return user, nil
+	}
+	if !provider.AutoProvision {
+		return user, fmt.Errorf("no user registered for subject %q at issuer %q", result.Sub, issuer)
+	}
+	return CreateUserWithExternalSubject(db.Db, issuer, result.Sub)
+}
+
+// bearerTokenIssuer extracts the issuer claim from an unverified JWT so the
+// caller can decide whether to verify it as a trackit-issued token or route
+// it to an OAuth provider. It does not check the token's signature.
+func bearerTokenIssuer(tokenString string) (string, bool) {
+	parts := strings.Split(tokenString, ".")
+	if len(parts) != 3 {
+		return "", false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", false
+	}
+	var claims struct {
+		Issuer string `json:"iss"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", false
+	}
+	return claims.Issuer, claims.Issuer != ""
+}
+
+// testBearerToken resolves a bearer token to a User, routing it to the
+// trackit-issued JWT verifier or to the matching OAuth provider based on the
+// token's issuer.
+func testBearerToken(ctx context.Context, tokenString string) (User, error) {
+	if issuer, ok := bearerTokenIssuer(tokenString); ok {
+		if _, isOAuthProvider := oauthProviders[issuer]; isOAuthProvider {
+			return testOAuthToken(ctx, issuer, tokenString)
+		}
+	}
+	return testToken(tokenString)
+}
@@ -0,0 +1,67 @@
+package users
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"reflect"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func TestPublicKeyFromJwkRoundTripsRSA(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	k, ok := jwkFromKey(&jwtKey{Id: "k1", Method: jwt.SigningMethodRS256, VerifyKey: &priv.PublicKey})
+	if !ok {
+		t.Fatalf("jwkFromKey() reported no public key for an RSA key")
+	}
+	got, err := publicKeyFromJwk(k)
+	if err != nil {
+		t.Fatalf("publicKeyFromJwk() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, &priv.PublicKey) {
+		t.Errorf("publicKeyFromJwk() = %+v, want %+v", got, &priv.PublicKey)
+	}
+}
+
+func TestPublicKeyFromJwkRoundTripsECDSA(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	k, ok := jwkFromKey(&jwtKey{Id: "k1", Method: jwt.SigningMethodES256, VerifyKey: &priv.PublicKey})
+	if !ok {
+		t.Fatalf("jwkFromKey() reported no public key for an ECDSA key")
+	}
+	got, err := publicKeyFromJwk(k)
+	if err != nil {
+		t.Fatalf("publicKeyFromJwk() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, &priv.PublicKey) {
+		t.Errorf("publicKeyFromJwk() = %+v, want %+v", got, &priv.PublicKey)
+	}
+}
+
+func TestPublicKeyFromJwkRoundTripsEd25519(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	k, ok := jwkFromKey(&jwtKey{Id: "k1", Method: jwt.SigningMethodEdDSA, VerifyKey: pub})
+	if !ok {
+		t.Fatalf("jwkFromKey() reported no public key for an Ed25519 key")
+	}
+	got, err := publicKeyFromJwk(k)
+	if err != nil {
+		t.Fatalf("publicKeyFromJwk() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, pub) {
+		t.Errorf("publicKeyFromJwk() = %+v, want %+v", got, pub)
+	}
+}
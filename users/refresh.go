@@ -0,0 +1,254 @@
+package users
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/trackit/trackit2/db"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// accessTokenLifetime is how long an access JWT remains valid. It is
+	// kept short since a compromised access token stays usable until it
+	// expires unless its jti is revoked (revoked_jti) or the user's
+	// TokenVersion is bumped.
+	accessTokenLifetime = 15 * time.Minute
+
+	// refreshTokenLifetime is how long a single refresh token can be used
+	// to mint a new access token after it was issued. Each rotation issues
+	// a new refresh token with a fresh lifetime, so a family that keeps
+	// being refreshed does not expire.
+	refreshTokenLifetime = 30 * 24 * time.Hour
+)
+
+// refreshToken is a row of the user_refresh_tokens table. Only a bcrypt hash
+// of the token's secret is ever stored; the secret itself is returned to the
+// client once, at issuance, and never persisted.
+type refreshToken struct {
+	Id         string
+	FamilyId   string
+	UserId     int
+	SecretHash string
+	Device     string
+	Amr        string // amr claim of the login this token descends from, comma-separated
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+	Rotated    bool
+	Revoked    bool
+}
+
+// generateToken issues a fresh access/refresh token pair for user, tagging
+// the refresh token with deviceMetadata (e.g. a user-agent string) so it can
+// later be told apart from the user's other sessions. The access token is a
+// short-lived JWT used for API calls; the refresh token is a long-lived
+// opaque secret used solely to mint new access tokens via POST /auth/refresh.
+func generateToken(user User, deviceMetadata string, amr []string) (accessToken, refresh string, err error) {
+	accessToken, err = generateAccessToken(user, amr)
+	if err != nil {
+		return "", "", err
+	}
+	familyId, err := newJti()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate refresh token family id: %w", err)
+	}
+	refresh, err = issueRefreshToken(db.Db, user.Id, familyId, deviceMetadata, strings.Join(amr, ","))
+	if err != nil {
+		return "", "", err
+	}
+	return accessToken, refresh, nil
+}
+
+// generateAccessToken generates a short-lived JWT for a given user, signed
+// with trackit's current key. amr lists the authentication methods used to
+// establish the session (e.g. ["pwd"] or ["pwd", "otp"]); testToken rejects
+// tokens carrying neither "otp" nor "recovery" for a user with two-factor
+// authentication enabled.
+func generateAccessToken(user User, amr []string) (string, error) {
+	key, err := jwtKeys.Current()
+	if err != nil {
+		return "", err
+	}
+	jti, err := newJti()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate token id: %w", err)
+	}
+	token := jwt.NewWithClaims(key.Method, jwtClaims{
+		Issuer:      jwtIssuer,
+		NotBefore:   time.Now().Add(-1 * time.Minute).Unix(),
+		Expires:     time.Now().Add(accessTokenLifetime).Unix(),
+		Subject:     user.Id,
+		Version:     user.TokenVersion,
+		Jti:         jti,
+		Amr:         amr,
+		MfaRequired: user.TotpEnabled,
+	})
+	token.Header["kid"] = key.Id
+	return token.SignedString(key.SigningKey)
+}
+
+// issueRefreshToken creates and stores a new refresh token in the given
+// family, returning the opaque token to hand to the client. The token is
+// formatted as "<id>.<secret>": id is used to look the row up, secret is
+// checked against SecretHash so the stored row never reveals a usable
+// token on its own.
+func issueRefreshToken(sqlDb *sql.DB, userId int, familyId, device, amr string) (string, error) {
+	id, err := newJti()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate refresh token id: %w", err)
+	}
+	secretRaw := make([]byte, 32)
+	if _, err := rand.Read(secretRaw); err != nil {
+		return "", fmt.Errorf("failed to generate refresh token secret: %w", err)
+	}
+	secret := hex.EncodeToString(secretRaw)
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bCryptCost)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash refresh token secret: %w", err)
+	}
+	const query = `INSERT INTO user_refresh_tokens(id, family_id, user_id, secret_hash, device, amr, created_at, last_used_at, rotated, revoked)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, false, false)`
+	now := time.Now()
+	if _, err := sqlDb.Exec(query, id, familyId, userId, string(hash), device, amr, now, now); err != nil {
+		return "", fmt.Errorf("failed to store refresh token: %w", err)
+	}
+	return id + "." + secret, nil
+}
+
+// getRefreshToken retrieves a refresh token row by id.
+func getRefreshToken(sqlDb *sql.DB, id string) (refreshToken, error) {
+	const query = `SELECT id, family_id, user_id, secret_hash, device, amr, created_at, last_used_at, rotated, revoked
+		FROM user_refresh_tokens WHERE id=?`
+	var rt refreshToken
+	err := sqlDb.QueryRow(query, id).Scan(&rt.Id, &rt.FamilyId, &rt.UserId, &rt.SecretHash, &rt.Device, &rt.Amr, &rt.CreatedAt, &rt.LastUsedAt, &rt.Rotated, &rt.Revoked)
+	return rt, err
+}
+
+// currentAmr returns the amr claim that should be stamped on an access
+// token minted from rt: the methods used at the original login that
+// started this refresh token's family.
+func currentAmr(rt refreshToken) []string {
+	if rt.Amr == "" {
+		return nil
+	}
+	return strings.Split(rt.Amr, ",")
+}
+
+// claimRefreshTokenRotation atomically flags a refresh token as spent,
+// succeeding only for the first caller to do so for a given token: the
+// UPDATE only matches a row that is not already rotated, so two concurrent
+// requests presenting the same token can never both succeed. It reports
+// false, with no error, if the token had already been rotated by a prior or
+// concurrent request, which HandleRefresh treats as token-family compromise.
+func claimRefreshTokenRotation(sqlDb *sql.DB, id string) (bool, error) {
+	const query = `UPDATE user_refresh_tokens SET rotated=true, last_used_at=? WHERE id=? AND rotated=false`
+	res, err := sqlDb.Exec(query, time.Now(), id)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+// revokeRefreshTokenFamily revokes every refresh token descended from the
+// same original login, in response to detecting reuse of a rotated token.
+func revokeRefreshTokenFamily(sqlDb *sql.DB, familyId string) error {
+	const query = `UPDATE user_refresh_tokens SET revoked=true WHERE family_id=?`
+	_, err := sqlDb.Exec(query, familyId)
+	return err
+}
+
+// refreshTokenRequest is the payload accepted by POST /auth/refresh.
+type refreshTokenRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// refreshTokenResponse is returned by POST /auth/refresh.
+type refreshTokenResponse struct {
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken"`
+}
+
+// HandleRefresh serves POST /auth/refresh: it exchanges a still-valid
+// refresh token for a new access/refresh pair, atomically claiming the
+// rotation so the one just presented can never be used again, even by a
+// concurrent request. Presenting a refresh token that was already rotated
+// away is treated as a sign the token was stolen, and revokes every token
+// in its family.
+func HandleRefresh(w http.ResponseWriter, r *http.Request) {
+	var req refreshTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body: %s", err), http.StatusBadRequest)
+		return
+	}
+	id, secret, ok := splitRefreshToken(req.RefreshToken)
+	if !ok {
+		http.Error(w, "malformed refresh token", http.StatusUnauthorized)
+		return
+	}
+	rt, err := getRefreshToken(db.Db, id)
+	if err != nil {
+		http.Error(w, "invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if rt.Revoked || time.Since(rt.CreatedAt) > refreshTokenLifetime {
+		http.Error(w, "refresh token is no longer valid", http.StatusUnauthorized)
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(rt.SecretHash), []byte(secret)) != nil {
+		http.Error(w, "invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	claimed, err := claimRefreshTokenRotation(db.Db, rt.Id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to rotate refresh token: %s", err), http.StatusInternalServerError)
+		return
+	}
+	if !claimed {
+		if err := revokeRefreshTokenFamily(db.Db, rt.FamilyId); err != nil {
+			fmt.Printf("users: failed to revoke refresh token family %q after reuse: %s\n", rt.FamilyId, err)
+		}
+		http.Error(w, "refresh token has already been used", http.StatusUnauthorized)
+		return
+	}
+	user, err := GetUserWithId(db.Db, rt.UserId)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to load user: %s", err), http.StatusInternalServerError)
+		return
+	}
+	accessToken, err := generateAccessToken(user, currentAmr(rt))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to generate access token: %s", err), http.StatusInternalServerError)
+		return
+	}
+	newRefreshToken, err := issueRefreshToken(db.Db, user.Id, rt.FamilyId, rt.Device, rt.Amr)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to generate refresh token: %s", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(refreshTokenResponse{
+		AccessToken:  accessToken,
+		RefreshToken: newRefreshToken,
+	})
+}
+
+// splitRefreshToken separates an opaque refresh token into its lookup id
+// and secret.
+func splitRefreshToken(token string) (id, secret string, ok bool) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
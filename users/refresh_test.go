@@ -0,0 +1,120 @@
+package users
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeRotationDriver is a minimal in-memory database/sql driver used only to
+// exercise claimRefreshTokenRotation's atomicity. It tracks a single
+// "rotated" flag per refresh token id behind a mutex, and its Exec only
+// succeeds for the first caller to flip a given id from false to true —
+// exactly like the real `UPDATE ... WHERE rotated=false` it stands in for.
+type fakeRotationDriver struct {
+	mu      sync.Mutex
+	rotated map[string]bool
+}
+
+func (d *fakeRotationDriver) Open(name string) (driver.Conn, error) {
+	return &fakeRotationConn{d: d}, nil
+}
+
+type fakeRotationConn struct {
+	d *fakeRotationDriver
+}
+
+func (c *fakeRotationConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("fakeRotationConn: Prepare is not supported")
+}
+
+func (c *fakeRotationConn) Close() error { return nil }
+
+func (c *fakeRotationConn) Begin() (driver.Tx, error) {
+	return nil, fmt.Errorf("fakeRotationConn: Begin is not supported")
+}
+
+// Exec implements the legacy driver.Execer interface. args are positional:
+// [last_used_at, id], matching claimRefreshTokenRotation's query.
+func (c *fakeRotationConn) Exec(query string, args []driver.Value) (driver.Result, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("fakeRotationConn: unexpected argument count %d", len(args))
+	}
+	id, ok := args[1].(string)
+	if !ok {
+		return nil, fmt.Errorf("fakeRotationConn: expected a string id argument")
+	}
+	c.d.mu.Lock()
+	defer c.d.mu.Unlock()
+	if c.d.rotated[id] {
+		return driver.RowsAffected(0), nil
+	}
+	c.d.rotated[id] = true
+	return driver.RowsAffected(1), nil
+}
+
+var fakeRotationDriverSeq int32
+
+func openFakeRotationDB(t *testing.T) *sql.DB {
+	driverName := fmt.Sprintf("fakerotation-%d", atomic.AddInt32(&fakeRotationDriverSeq, 1))
+	sql.Register(driverName, &fakeRotationDriver{rotated: make(map[string]bool)})
+	db, err := sql.Open(driverName, "")
+	if err != nil {
+		t.Fatalf("sql.Open() error = %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestClaimRefreshTokenRotationIsAtomicUnderConcurrency(t *testing.T) {
+	db := openFakeRotationDB(t)
+
+	const attempts = 20
+	var wg sync.WaitGroup
+	results := make([]bool, attempts)
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			claimed, err := claimRefreshTokenRotation(db, "rt1")
+			if err != nil {
+				t.Errorf("claimRefreshTokenRotation() error = %v", err)
+			}
+			results[i] = claimed
+		}(i)
+	}
+	wg.Wait()
+
+	wins := 0
+	for _, claimed := range results {
+		if claimed {
+			wins++
+		}
+	}
+	if wins != 1 {
+		t.Fatalf("claimRefreshTokenRotation() succeeded %d times concurrently for the same token, want exactly 1", wins)
+	}
+}
+
+func TestClaimRefreshTokenRotationRejectsSecondAttempt(t *testing.T) {
+	db := openFakeRotationDB(t)
+
+	first, err := claimRefreshTokenRotation(db, "rt1")
+	if err != nil {
+		t.Fatalf("claimRefreshTokenRotation() error = %v", err)
+	}
+	if !first {
+		t.Fatalf("claimRefreshTokenRotation() first call = false, want true")
+	}
+
+	second, err := claimRefreshTokenRotation(db, "rt1")
+	if err != nil {
+		t.Fatalf("claimRefreshTokenRotation() error = %v", err)
+	}
+	if second {
+		t.Fatalf("claimRefreshTokenRotation() second call = true, want false (reuse of an already-rotated token)")
+	}
+}
@@ -0,0 +1,130 @@
+package users
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/trackit/trackit2/db"
+)
+
+// revokedTokensPruneInterval is how often pruneExpiredRevocations removes
+// rows for tokens that have already expired on their own, so the
+// revoked_jti table does not grow unbounded.
+const revokedTokensPruneInterval = 24 * time.Hour
+
+// isJtiRevoked reports whether a token id has been individually revoked via
+// POST /user/tokens/revoke.
+func isJtiRevoked(sqlDb *sql.DB, jti string) (bool, error) {
+	const query = `SELECT 1 FROM revoked_jti WHERE jti=? LIMIT 1`
+	var found int
+	err := sqlDb.QueryRow(query, jti).Scan(&found)
+	switch err {
+	case nil:
+		return true, nil
+	case sql.ErrNoRows:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// revokeJti blacklists a single token, identified by its jti claim, until it
+// would have expired anyway.
+func revokeJti(sqlDb *sql.DB, jti string, userId int, expiresAt time.Time) error {
+	const query = `INSERT INTO revoked_jti(jti, user_id, expires_at) VALUES (?, ?, ?)`
+	_, err := sqlDb.Exec(query, jti, userId, expiresAt)
+	return err
+}
+
+// pruneExpiredRevocations deletes revoked_jti rows whose token has already
+// expired on its own: once expired, the token is rejected by areClaimsValid
+// regardless, so keeping the row around serves no purpose.
+func pruneExpiredRevocations(sqlDb *sql.DB) error {
+	const query = `DELETE FROM revoked_jti WHERE expires_at < ?`
+	_, err := sqlDb.Exec(query, time.Now())
+	return err
+}
+
+// StartRevocationPruner runs pruneExpiredRevocations on a fixed interval
+// until stop is closed. It is meant to be launched once as a background
+// goroutine at server startup.
+func StartRevocationPruner(stop <-chan struct{}) {
+	ticker := time.NewTicker(revokedTokensPruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := pruneExpiredRevocations(db.Db); err != nil {
+				fmt.Printf("users: failed to prune expired revoked tokens: %s\n", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// incrementTokenVersion bumps a user's token version, invalidating every
+// access token issued to them before this call.
+func incrementTokenVersion(sqlDb *sql.DB, userId int) error {
+	const query = `UPDATE user SET token_version = token_version + 1 WHERE id=?`
+	_, err := sqlDb.Exec(query, userId)
+	return err
+}
+
+// HandleLogoutAll serves POST /user/logout-all: it increments the calling
+// user's token version and revokes all of their refresh tokens, immediately
+// invalidating every token issued to them so far, including the one used to
+// authenticate this very request.
+func HandleLogoutAll(w http.ResponseWriter, r *http.Request, user User) {
+	if err := incrementTokenVersion(db.Db, user.Id); err != nil {
+		http.Error(w, fmt.Sprintf("failed to log out all sessions: %s", err), http.StatusInternalServerError)
+		return
+	}
+	const revokeRefreshTokens = `UPDATE user_refresh_tokens SET revoked=true WHERE user_id=?`
+	if _, err := db.Db.Exec(revokeRefreshTokens, user.Id); err != nil {
+		http.Error(w, fmt.Sprintf("failed to log out all sessions: %s", err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// revokeTokenRequest is the payload accepted by POST /user/tokens/revoke.
+type revokeTokenRequest struct {
+	Token string `json:"token"`
+}
+
+// HandleRevokeToken serves POST /user/tokens/revoke: it blacklists a single
+// access token, without affecting the user's other active tokens. The
+// caller must present the token itself, not just its jti, so the handler
+// can verify it was issued to the calling user before revoking it —
+// otherwise anyone who ever observed a jti (a log line, a shared proxy)
+// could force-expire someone else's session.
+func HandleRevokeToken(w http.ResponseWriter, r *http.Request, user User) {
+	var req revokeTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body: %s", err), http.StatusBadRequest)
+		return
+	}
+	token, _, err := parseTokenWithKeySet(req.Token)
+	if err != nil {
+		http.Error(w, "invalid token", http.StatusBadRequest)
+		return
+	}
+	claims, ok := token.Claims.(*jwtClaims)
+	if !ok {
+		http.Error(w, "invalid token", http.StatusBadRequest)
+		return
+	}
+	if claims.Subject != user.Id {
+		http.Error(w, "token does not belong to the calling user", http.StatusForbidden)
+		return
+	}
+	if err := revokeJti(db.Db, claims.Jti, user.Id, time.Unix(claims.Expires, 0)); err != nil {
+		http.Error(w, fmt.Sprintf("failed to revoke token: %s", err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
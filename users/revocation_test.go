@@ -0,0 +1,32 @@
+package users
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func TestHandleRevokeTokenRejectsTokenNotOwnedByCaller(t *testing.T) {
+	ks := NewKeySet()
+	ks.AddKey(&jwtKey{Id: "test", Method: jwt.SigningMethodHS256, SigningKey: []byte("secret"), VerifyKey: []byte("secret")}, true)
+	prevKeys, prevIssuer := jwtKeys, jwtIssuer
+	jwtKeys, jwtIssuer = ks, "trackit-test"
+	defer func() { jwtKeys, jwtIssuer = prevKeys, prevIssuer }()
+
+	token, err := generateAccessToken(User{Id: 1}, []string{"pwd"})
+	if err != nil {
+		t.Fatalf("generateAccessToken() error = %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/user/tokens/revoke", strings.NewReader(`{"token":"`+token+`"}`))
+	rec := httptest.NewRecorder()
+
+	HandleRevokeToken(rec, req, User{Id: 2})
+
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("HandleRevokeToken() status = %d, want %d; a token minted for another user must not be revocable by the caller", rec.Code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,354 @@
+package users
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image/png"
+	"net/http"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"github.com/trackit/trackit2/config"
+	"github.com/trackit/trackit2/db"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// totpEncryptionKey encrypts TOTP secrets at rest, so that a database leak
+// alone does not let an attacker generate valid codes. It must be 16, 24 or
+// 32 bytes long (AES-128/192/256).
+var totpEncryptionKey []byte
+
+func init() {
+	totpEncryptionKey = config.LoadConfiguration().TotpEncryptionKey
+}
+
+// encryptTotpSecret encrypts a TOTP secret with AES-GCM, returning a
+// hex-encoded nonce||ciphertext suitable for storage in the totp_secret
+// column.
+func encryptTotpSecret(secret string) (string, error) {
+	block, err := aes.NewCipher(totpEncryptionKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to build TOTP secret cipher: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", fmt.Errorf("failed to build TOTP secret cipher: %w", err)
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(secret), nil)
+	return hex.EncodeToString(sealed), nil
+}
+
+// decryptTotpSecret reverses encryptTotpSecret.
+func decryptTotpSecret(encrypted string) (string, error) {
+	sealed, err := hex.DecodeString(encrypted)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode TOTP secret: %w", err)
+	}
+	block, err := aes.NewCipher(totpEncryptionKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to build TOTP secret cipher: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", fmt.Errorf("failed to build TOTP secret cipher: %w", err)
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", fmt.Errorf("TOTP secret is truncated")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plain, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt TOTP secret: %w", err)
+	}
+	return string(plain), nil
+}
+
+// setPendingTotpSecret stores a newly generated, not-yet-confirmed TOTP
+// secret for a user, ahead of enrollment verification.
+func setPendingTotpSecret(sqlDb *sql.DB, userId int, encryptedSecret string) error {
+	const query = `UPDATE user SET totp_secret=?, totp_enabled=false WHERE id=?`
+	_, err := sqlDb.Exec(query, encryptedSecret, userId)
+	return err
+}
+
+// enableTotp marks a user's TOTP secret as confirmed and active.
+func enableTotp(sqlDb *sql.DB, userId int) error {
+	const query = `UPDATE user SET totp_enabled=true WHERE id=?`
+	_, err := sqlDb.Exec(query, userId)
+	return err
+}
+
+// disableTotp clears a user's TOTP secret and recovery codes, turning
+// two-factor authentication off for their account.
+func disableTotp(sqlDb *sql.DB, userId int) error {
+	const query = `UPDATE user SET totp_secret=NULL, totp_enabled=false WHERE id=?`
+	_, err := sqlDb.Exec(query, userId)
+	if err != nil {
+		return err
+	}
+	const deleteCodes = `DELETE FROM user_recovery_codes WHERE user_id=?`
+	_, err = sqlDb.Exec(deleteCodes, userId)
+	return err
+}
+
+// storeRecoveryCodes replaces a user's one-time recovery codes with newly
+// generated ones, storing only their bcrypt hashes.
+func storeRecoveryCodes(sqlDb *sql.DB, userId int, count int) ([]string, error) {
+	const deleteExisting = `DELETE FROM user_recovery_codes WHERE user_id=?`
+	if _, err := sqlDb.Exec(deleteExisting, userId); err != nil {
+		return nil, fmt.Errorf("failed to clear existing recovery codes: %w", err)
+	}
+	codes := make([]string, count)
+	for i := range codes {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate recovery code: %w", err)
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(code), bCryptCost)
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash recovery code: %w", err)
+		}
+		const insert = `INSERT INTO user_recovery_codes(user_id, code_hash, used) VALUES (?, ?, false)`
+		if _, err := sqlDb.Exec(insert, userId, string(hash)); err != nil {
+			return nil, fmt.Errorf("failed to store recovery code: %w", err)
+		}
+		codes[i] = code
+	}
+	return codes, nil
+}
+
+// newRecoveryCode generates a single human-typeable one-time recovery code,
+// a 16-character base32 string.
+func newRecoveryCode() (string, error) {
+	raw := make([]byte, 10)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	encoded := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(raw)
+	return encoded, nil
+}
+
+// redeemRecoveryCode checks code against a user's stored, unused recovery
+// codes, and marks the matching one as used so it cannot be redeemed again.
+// It reports false, with no error, if code does not match any unused code.
+func redeemRecoveryCode(sqlDb *sql.DB, userId int, code string) (bool, error) {
+	const query = `SELECT id, code_hash FROM user_recovery_codes WHERE user_id=? AND used=false`
+	rows, err := sqlDb.Query(query, userId)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	var matchedId int
+	for rows.Next() {
+		var id int
+		var hash string
+		if err := rows.Scan(&id, &hash); err != nil {
+			return false, err
+		}
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(code)) == nil {
+			matchedId = id
+			break
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	if matchedId == 0 {
+		return false, nil
+	}
+	const markUsed = `UPDATE user_recovery_codes SET used=true WHERE id=?`
+	if _, err := sqlDb.Exec(markUsed, matchedId); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// enrollTotpResponse is returned by POST /user/totp/enroll.
+type enrollTotpResponse struct {
+	ProvisioningUri string `json:"provisioningUri"`
+	QrPngBase64     string `json:"qrPngBase64"`
+}
+
+// HandleEnrollTotp serves POST /user/totp/enroll: it generates a new TOTP
+// secret for the calling user and returns its provisioning URI, along with
+// a QR code encoding that URI for scanning into an authenticator app. The
+// secret is stored but not yet active until confirmed via HandleVerifyTotp.
+// It refuses to re-enroll an account that already has two-factor
+// authentication enabled; HandleDisableTotp must be used first.
+func HandleEnrollTotp(w http.ResponseWriter, r *http.Request, user User) {
+	if user.TotpEnabled {
+		http.Error(w, "two-factor authentication is already enabled for this account", http.StatusConflict)
+		return
+	}
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      jwtIssuer,
+		AccountName: user.Email,
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to generate TOTP secret: %s", err), http.StatusInternalServerError)
+		return
+	}
+	encrypted, err := encryptTotpSecret(key.Secret())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to store TOTP secret: %s", err), http.StatusInternalServerError)
+		return
+	}
+	if err := setPendingTotpSecret(db.Db, user.Id, encrypted); err != nil {
+		http.Error(w, fmt.Sprintf("failed to store TOTP secret: %s", err), http.StatusInternalServerError)
+		return
+	}
+	image, err := key.Image(256, 256)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to generate QR code: %s", err), http.StatusInternalServerError)
+		return
+	}
+	var qrPng bytes.Buffer
+	if err := png.Encode(&qrPng, image); err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode QR code: %s", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(enrollTotpResponse{
+		ProvisioningUri: key.String(),
+		QrPngBase64:     base64.StdEncoding.EncodeToString(qrPng.Bytes()),
+	})
+}
+
+// verifyTotpRequest is the payload accepted by POST /user/totp/verify.
+type verifyTotpRequest struct {
+	Code string `json:"code"`
+}
+
+// verifyTotpResponse is returned by POST /user/totp/verify.
+type verifyTotpResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+// recoveryCodeCount is how many one-time recovery codes are generated when
+// a user confirms their TOTP enrollment.
+const recoveryCodeCount = 10
+
+// HandleVerifyTotp serves POST /user/totp/verify: it confirms a pending TOTP
+// enrollment by checking a code generated from it, activates two-factor
+// authentication for the account, and returns a fresh set of recovery codes.
+func HandleVerifyTotp(w http.ResponseWriter, r *http.Request, user User) {
+	var req verifyTotpRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body: %s", err), http.StatusBadRequest)
+		return
+	}
+	secret, err := decryptTotpSecret(user.TotpSecret)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read TOTP secret: %s", err), http.StatusInternalServerError)
+		return
+	}
+	valid, err := totp.ValidateCustom(req.Code, secret, time.Now(), totp.ValidateOpts{
+		Period:    30,
+		Skew:      1,
+		Digits:    otp.DigitsSix,
+		Algorithm: otp.AlgorithmSHA1,
+	})
+	if err != nil || !valid {
+		http.Error(w, "invalid TOTP code", http.StatusUnauthorized)
+		return
+	}
+	if err := enableTotp(db.Db, user.Id); err != nil {
+		http.Error(w, fmt.Sprintf("failed to enable two-factor authentication: %s", err), http.StatusInternalServerError)
+		return
+	}
+	codes, err := storeRecoveryCodes(db.Db, user.Id, recoveryCodeCount)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to generate recovery codes: %s", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(verifyTotpResponse{RecoveryCodes: codes})
+}
+
+// disableTotpRequest is the payload accepted by POST /user/totp/disable.
+type disableTotpRequest struct {
+	Password string `json:"password"`
+}
+
+// HandleDisableTotp serves POST /user/totp/disable: it turns off two-factor
+// authentication for the calling user, after reconfirming their password so
+// a stolen access token alone cannot be used to drop 2FA protection.
+func HandleDisableTotp(w http.ResponseWriter, r *http.Request, user User) {
+	var req disableTotpRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body: %s", err), http.StatusBadRequest)
+		return
+	}
+	if err := passwordMatchesHash(req.Password, user.Password); err != nil {
+		http.Error(w, "incorrect password", http.StatusUnauthorized)
+		return
+	}
+	if err := disableTotp(db.Db, user.Id); err != nil {
+		http.Error(w, fmt.Sprintf("failed to disable two-factor authentication: %s", err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// recoveryLoginRequest is the payload accepted by POST /auth/recovery.
+type recoveryLoginRequest struct {
+	AccessToken string `json:"accessToken"`
+	Code        string `json:"code"`
+}
+
+// HandleRecoveryLogin serves POST /auth/recovery: it completes a login for a
+// user who has enrolled two-factor authentication but lost access to their
+// TOTP device, by redeeming one of their one-time recovery codes in place of
+// a TOTP code. accessToken is the short-lived, MFA-incomplete token minted
+// by the password login step (amr ["pwd"], MfaRequired true), which testToken
+// otherwise refuses to accept for a TOTP-enabled account. On success it is
+// exchanged for a full access/refresh pair carrying "recovery" in its amr
+// claim, and the code is consumed so it cannot be redeemed again.
+func HandleRecoveryLogin(w http.ResponseWriter, r *http.Request) {
+	var req recoveryLoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body: %s", err), http.StatusBadRequest)
+		return
+	}
+	user, claims, err := verifyAccessToken(req.AccessToken)
+	if err != nil {
+		http.Error(w, "invalid or expired login token", http.StatusUnauthorized)
+		return
+	}
+	if !user.TotpEnabled {
+		http.Error(w, "two-factor authentication is not enabled for this account", http.StatusBadRequest)
+		return
+	}
+	ok, err := redeemRecoveryCode(db.Db, user.Id, req.Code)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to verify recovery code: %s", err), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "invalid or already used recovery code", http.StatusUnauthorized)
+		return
+	}
+	accessToken, refreshToken, err := generateToken(user, "", append(claims.Amr, "recovery"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to generate token: %s", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(refreshTokenResponse{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+	})
+}
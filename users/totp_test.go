@@ -0,0 +1,24 @@
+package users
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestNewRecoveryCodeFormat(t *testing.T) {
+	pattern := regexp.MustCompile(`^[A-Z2-7]{16}$`)
+	seen := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		code, err := newRecoveryCode()
+		if err != nil {
+			t.Fatalf("newRecoveryCode() error = %v", err)
+		}
+		if !pattern.MatchString(code) {
+			t.Fatalf("newRecoveryCode() = %q, does not match %s", code, pattern)
+		}
+		if seen[code] {
+			t.Fatalf("newRecoveryCode() produced a repeat: %q", code)
+		}
+		seen[code] = true
+	}
+}